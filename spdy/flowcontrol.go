@@ -0,0 +1,84 @@
+package spdy
+
+import "sync"
+
+/*
+** Flow control
+**
+** SPDY/3 lets either side throttle how much DATA the other is allowed to
+** send: every stream has its own send/receive window (initially 64 KB,
+** see section 2.6.9), and on top of that there is a connection-wide
+** window so that one greedy stream can't starve the others. A flowWindow
+** is the building block for both: a byte counter with a condition
+** variable so writers can block until the peer replenishes it with a
+** WINDOW_UPDATE.
+*/
+
+const defaultInitialWindowSize int32 = 65536 // 64 KB, per section 2.6.9
+
+type flowWindow struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int64
+	closed bool
+}
+
+func newFlowWindow(initial int32) *flowWindow {
+	w := &flowWindow{size: int64(initial)}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+/*
+** Reserve blocks until the window has at least one byte of credit, then
+** grants up to `want` bytes (possibly less, if the window is smaller),
+** deducting the grant from the window. Callers use the returned amount to
+** decide how much of a DATA frame they may send before checking again,
+** which is how a blocked Send() ends up chunking its output.
+**
+** If the window is closed (its stream or session tore down while a writer
+** was waiting on credit that's never coming), Reserve gives up and returns
+** -1 instead of blocking forever.
+*/
+func (w *flowWindow) Reserve(want int32) int32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.size <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return -1
+	}
+	granted := int64(want)
+	if granted > w.size {
+		granted = w.size
+	}
+	w.size -= granted
+	return int32(granted)
+}
+
+/* Increase credits the window by `n` bytes and wakes any blocked writer. */
+func (w *flowWindow) Increase(n int32) {
+	w.mu.Lock()
+	w.size += int64(n)
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+/*
+** Close marks the window closed and wakes every writer currently blocked
+** in Reserve, so a stream or session tearing down doesn't leave a writer
+** waiting on send-window credit that will now never arrive.
+*/
+func (w *flowWindow) Close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+func (w *flowWindow) Size() int32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int32(w.size)
+}
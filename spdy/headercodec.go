@@ -0,0 +1,173 @@
+package spdy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+** Header compression
+**
+** The SPDY spec compresses HEADERS/SYN_STREAM/SYN_REPLY header blocks with
+** a zlib stream whose dictionary and sliding window are never reset
+** between frames (section 2.6.10): decoding frame N depends on every
+** header block decoded before it on that connection. A Session therefore
+** owns one persistent zlib stream per direction, seeded with the spec's
+** fixed dictionary, instead of treating each frame's header block as
+** independent the way the rest of this package treats DATA.
+ */
+
+// Version records which SPDY draft a Session negotiates. newHeaderCodec
+// takes it as a parameter but seeds both directions with
+// spdyHeaderDictionary whichever version is given, and nothing else in
+// this package reads it.
+type Version int
+
+const (
+	Version2 Version = 2
+	Version3 Version = 3
+)
+
+// spdyHeaderDictionary is the fixed zlib dictionary every SPDY header
+// block is compressed against, per draft-mbelshe-httpbis-spdy-00 section
+// 2.6.10. It's full of the header names and values real HTTP traffic
+// repeats constantly, so the first header block on a connection already
+// compresses well instead of paying for its own dictionary.
+var spdyHeaderDictionary = []byte("optionsgetheadpostputdeletetraceacceptaccept-charsetaccept-encodingaccept-languageauthorizationexpectfromhostif-modifiedsinceif-matchif-nonematchif-rangeif-unmodifiedsincemax-forwardsproxy-authorizationrangerefererteuser-agent100101200201202203204205206300302303304305306307400401402403404405406407408409410411412413414415416417500501502503504505accept-rangesageetaglocationproxy-authenticatepublicretry-afterservervarywarningwww-authenticateallowcontent-basecontent-encodingcache-controlconnectiondatetrailertransfer-encodingupgradeviawarningcontent-languagecontent-lengthcontent-locationcontent-md5content-rangecontent-typeetagexpireslast-modifiedset-cookieMondayTuesdayWednesdayThursdayFridaySaturdaySundayJanFebMarAprMayJunJulAugSepOctNovDecchunkedtext/htmlimage/pngimage/jpgimage/gifapplication/xmlapplication/xhtmltext/plainpublicmax-agecharset=iso-8859-1utf-8gzipdeflateHTTP/1.1statusversionurl\x00")
+
+// headerWindowSize is deflate's maximum match distance (see RFC 1951
+// section 2.3): plaintext further back than this can never be referenced
+// by a later block, so it's how far back Decode needs to keep history.
+const headerWindowSize = 32768
+
+// zlibDictHeaderLen is the length of the RFC 1950 framing zlib.Writer
+// emits before the first deflate block when it's given a preset
+// dictionary: a 2-byte CMF/FLG header plus, since FLG's FDICT bit is set,
+// a 4-byte dictionary id. It appears exactly once, at the very start of
+// the stream, never again on later Flush()-delimited chunks.
+const zlibDictHeaderLen = 6
+
+/*
+** headerCodec serializes access to the two persistent compression streams
+** a session's header blocks are compressed with, one per direction, so
+** that encode/decode calls always happen in wire order even though frames
+** for several streams can be in flight concurrently.
+**
+** Encode is a straightforward persistent zlib.Writer: Flush() after each
+** header block emits a sync-flush deflate block without resetting the
+** stream, which is exactly the "dictionary and window never reset between
+** frames" behavior section 2.6.10 requires.
+**
+** Decode can't mirror that with a persistent zlib.Reader: compress/flate's
+** decompressor latches its error permanently once Flush()'s sync-flush
+** block makes it probe for the next block header and hit the end of
+** however much compressed data has arrived so far. Instead, every call
+** builds a fresh flate.Reader over just the new compressed bytes (which
+** already end with Flush()'s sync-flush marker, 0x00 0x00 0xff 0xff),
+** using the plaintext decoded so far as that reader's dictionary so it
+** sees the same window a persistent stream would have. The resulting
+** io.ErrUnexpectedEOF is the expected end of this chunk, not a failure.
+ */
+type headerCodec struct {
+	mu sync.Mutex
+
+	zwBuf *bytes.Buffer
+	zw    *zlib.Writer
+
+	history     []byte
+	firstDecode bool
+}
+
+func newHeaderCodec(version Version) *headerCodec {
+	zwBuf := new(bytes.Buffer)
+	zw, _ := zlib.NewWriterLevelDict(zwBuf, zlib.DefaultCompression, spdyHeaderDictionary)
+	history := make([]byte, len(spdyHeaderDictionary))
+	copy(history, spdyHeaderDictionary)
+	return &headerCodec{
+		zwBuf:       zwBuf,
+		zw:          zw,
+		history:     history,
+		firstDecode: true,
+	}
+}
+
+/*
+** Encode compresses `block`, an already name/value-serialized SPDY header
+** block, against the session's outbound zlib stream and returns the bytes
+** to put on the wire.
+ */
+func (c *headerCodec) Encode(block []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.zwBuf.Reset()
+	if _, err := c.zw.Write(block); err != nil {
+		return nil, err
+	}
+	if err := c.zw.Flush(); err != nil {
+		return nil, err
+	}
+	out := make([]byte, c.zwBuf.Len())
+	copy(out, c.zwBuf.Bytes())
+	return out, nil
+}
+
+/*
+** Decode decompresses `compressed` against the session's inbound zlib
+** stream and returns the serialized name/value header block. A failure
+** here is fatal per spec: the dictionary and window are now out of sync,
+** so every later header block on the connection would decode incorrectly
+** too. Callers should treat any returned error as a *headerDecodeError
+** and tear down the session rather than try to recover.
+ */
+func (c *headerCodec) Decode(compressed []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.firstDecode {
+		// zlib.Writer's RFC 1950 framing only appears once, at the very
+		// start of the stream; compress/flate doesn't know about it, so it
+		// has to come off before the first block reaches a flate.Reader.
+		if len(compressed) < zlibDictHeaderLen {
+			return nil, &headerDecodeError{errors.New("header block shorter than zlib stream header")}
+		}
+		compressed = compressed[zlibDictHeaderLen:]
+		c.firstDecode = false
+	}
+
+	dict := c.history
+	if len(dict) > headerWindowSize {
+		dict = dict[len(dict)-headerWindowSize:]
+	}
+	// Append one more empty stored-block marker (0x00 0x00 0xff 0xff).
+	// The chunk already ends with one from Flush, so this changes nothing
+	// in what is decoded: the reader still stops with io.ErrUnexpectedEOF
+	// once the input runs out, which is accepted below as the chunk's end.
+	src := io.MultiReader(bytes.NewReader(compressed), bytes.NewReader([]byte{0, 0, 0xff, 0xff}))
+	zr := flate.NewReaderDict(src, dict)
+	decoded, err := io.ReadAll(zr)
+	zr.Close()
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, &headerDecodeError{err}
+	}
+
+	c.history = append(c.history, decoded...)
+	if len(c.history) > headerWindowSize {
+		c.history = c.history[len(c.history)-headerWindowSize:]
+	}
+	return decoded, nil
+}
+
+// headerDecodeError marks a header-block decompression failure as fatal:
+// Session.run sends PROTOCOL_ERROR and tears the session down instead of
+// trying to continue reading frames.
+type headerDecodeError struct {
+	err error
+}
+
+func (e *headerDecodeError) Error() string {
+	return "spdy: header decompression failed: " + e.err.Error()
+}
@@ -0,0 +1,33 @@
+package spdy
+
+import "testing"
+
+// TestHeaderCodecRoundTrip exercises several header blocks through one
+// headerCodec's Encode/Decode in sequence, the way Session would use it
+// for consecutive frames on the same connection: Decode must keep
+// reconstructing the right sliding-window history across calls rather
+// than losing it (or latching a stale error) after the first block.
+func TestHeaderCodecRoundTrip(t *testing.T) {
+	blocks := [][]byte{
+		[]byte("GET /index.html HTTP/1.1"),
+		[]byte("GET /style.css HTTP/1.1, accept-encoding: gzip, deflate"),
+		[]byte("POST /submit HTTP/1.1"),
+	}
+
+	enc := newHeaderCodec(Version3)
+	dec := newHeaderCodec(Version3)
+
+	for i, block := range blocks {
+		compressed, err := enc.Encode(block)
+		if err != nil {
+			t.Fatalf("block %d: Encode: %s", i, err)
+		}
+		decoded, err := dec.Decode(compressed)
+		if err != nil {
+			t.Fatalf("block %d: Decode: %s", i, err)
+		}
+		if string(decoded) != string(block) {
+			t.Fatalf("block %d: got %q, want %q", i, decoded, block)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package spdy
+
+import (
+	"context"
+	"time"
+)
+
+/*
+** Keepalive / health
+**
+** SPDY PING frames (section 2.6.6) are pure echo: whichever side wants to
+** measure RTT or check the connection is alive sends one with an ID of
+** its own parity (clients use odd IDs, servers even, the same rule as
+** stream IDs), and the peer echoes it back unchanged. Session uses that
+** for two things: Ping lets a caller force a round-trip probe, and the
+** PingInterval/PingTimeout pair below detects a peer that stopped
+** answering. IdleTimeout is the coarser fallback for a peer that stopped
+** sending anything at all.
+*/
+
+// keepaliveGranularity is how often the keepalive loop wakes up to check
+// PingInterval/IdleTimeout; it bounds how late a timeout can fire, not how
+// often pings actually go out.
+const keepaliveGranularity = 1 * time.Second
+
+func (session *Session) keepaliveLoop() {
+	ticker := time.NewTicker(keepaliveGranularity)
+	defer ticker.Stop()
+	for range ticker.C {
+		if session.Closed() {
+			return
+		}
+		// Checked on every tick rather than once at startup: NewSession
+		// starts this loop before its caller can set these fields.
+		if session.PingInterval <= 0 && session.IdleTimeout <= 0 {
+			continue
+		}
+		if session.IdleTimeout > 0 && time.Since(session.lastFrameTime()) >= session.IdleTimeout {
+			debug("Session idle for over %s, sending GOAWAY\n", session.IdleTimeout)
+			session.goAway(Ok)
+			return
+		}
+		if session.PingInterval > 0 && time.Since(session.lastPingSentAt()) >= session.PingInterval {
+			go session.probePing()
+		}
+	}
+}
+
+/* probePing is the internal health-check probe driven by PingInterval; a
+   caller-initiated probe goes through Ping directly. A probe that times
+   out means the peer stopped answering, so we give up on the session. */
+func (session *Session) probePing() {
+	ctx := context.Background()
+	if session.PingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, session.PingTimeout)
+		defer cancel()
+	}
+	if _, err := session.Ping(ctx); err != nil {
+		debug("Ping unanswered within timeout, closing session: %s\n", err)
+		session.goAway(Ok)
+	}
+}
+
+/*
+** Ping sends a PING frame and blocks until the peer echoes it back or ctx
+** is done, returning the measured round-trip time.
+*/
+func (session *Session) Ping(ctx context.Context) (time.Duration, error) {
+	id := session.nextPingId()
+	done := make(chan time.Duration, 1)
+
+	session.pingMu.Lock()
+	session.pingWaiters[id] = done
+	session.pingSentAt[id] = time.Now()
+	session.lastPingAt = session.pingSentAt[id]
+	session.pingMu.Unlock()
+
+	if err := session.WriteFrame(&PingFrame{Id: id}); err != nil {
+		session.pingMu.Lock()
+		delete(session.pingWaiters, id)
+		delete(session.pingSentAt, id)
+		session.pingMu.Unlock()
+		return 0, err
+	}
+
+	select {
+	case rtt := <-done:
+		return rtt, nil
+	case <-ctx.Done():
+		session.pingMu.Lock()
+		delete(session.pingWaiters, id)
+		delete(session.pingSentAt, id)
+		session.pingMu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// LastRTT returns the round-trip time measured by the most recently
+// answered PING (forced or automatic), or 0 if none has completed yet.
+func (session *Session) LastRTT() time.Duration {
+	session.pingMu.Lock()
+	defer session.pingMu.Unlock()
+	return session.lastRTT
+}
+
+func (session *Session) nextPingId() uint32 {
+	session.pingMu.Lock()
+	defer session.pingMu.Unlock()
+	if session.lastPingId == 0 {
+		if session.Server {
+			session.lastPingId = 2
+		} else {
+			session.lastPingId = 1
+		}
+	} else {
+		session.lastPingId += 2
+	}
+	return session.lastPingId
+}
+
+// lastPingSentAt returns when the most recent PING was sent, whether or
+// not it has completed yet. This has to be tracked separately from
+// pingSentAt, which Ping deletes from the moment a probe is answered or
+// given up on: scanning pingSentAt for the max timestamp looked right but
+// went to zero value the instant the in-flight set emptied out, which on
+// a healthy connection is right after every PING gets answered -- making
+// keepaliveLoop think no ping had ever been sent and fire a new one on
+// every tick instead of respecting PingInterval.
+func (session *Session) lastPingSentAt() time.Time {
+	session.pingMu.Lock()
+	defer session.pingMu.Unlock()
+	return session.lastPingAt
+}
+
+/*
+** processPing handles a PING frame seen in Session.processFrame: if it
+** answers one of ours, it completes the matching Ping() call and records
+** the RTT; otherwise the peer is probing us, so we echo it straight back
+** unchanged, per section 2.6.6.
+*/
+func (session *Session) processPing(frame *PingFrame) {
+	session.pingMu.Lock()
+	done, isOurs := session.pingWaiters[frame.Id]
+	var rtt time.Duration
+	if isOurs {
+		rtt = time.Since(session.pingSentAt[frame.Id])
+		session.lastRTT = rtt
+		delete(session.pingWaiters, frame.Id)
+		delete(session.pingSentAt, frame.Id)
+	}
+	session.pingMu.Unlock()
+
+	if isOurs {
+		done <- rtt
+		return
+	}
+	debug("PING %d: echoing back\n", frame.Id)
+	session.WriteFrame(frame)
+}
+
+func (session *Session) touchLastFrame() {
+	session.lastFrameMu.Lock()
+	session.lastFrameAt = time.Now()
+	session.lastFrameMu.Unlock()
+}
+
+func (session *Session) lastFrameTime() time.Time {
+	session.lastFrameMu.Lock()
+	defer session.lastFrameMu.Unlock()
+	return session.lastFrameAt
+}
+
+/* goAway sends a GOAWAY advertising the last stream id we accepted and
+   closes the session. It's the blunt, non-draining shutdown used by the
+   keepalive subsystem; Session.Shutdown offers a graceful alternative. */
+func (session *Session) goAway(status StatusCode) {
+	session.WriteFrame(&GoAwayFrame{
+		LastGoodStreamId: session.lastStreamIdIn,
+		Status:           status,
+	})
+	session.Close()
+}
@@ -0,0 +1,41 @@
+package spdy
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLastPingSentAtSurvivesCompletion reproduces a pacing bug a review
+// caught: lastPingSentAt used to scan pingSentAt for the most recent
+// timestamp, but Ping/processPing delete from pingSentAt the moment a
+// probe is answered or given up on. On a healthy connection that map goes
+// empty again right after the very first ping round-trips, so
+// lastPingSentAt silently reset to the zero value and keepaliveLoop
+// treated that as "no ping has ever been sent," firing a new probe on
+// every tick regardless of PingInterval. lastPingSentAt must keep
+// reporting when the last PING went out even after it has completed.
+func TestLastPingSentAtSurvivesCompletion(t *testing.T) {
+	session := &Session{
+		pingSentAt:  make(map[uint32]time.Time),
+		pingWaiters: make(map[uint32]chan time.Duration),
+	}
+
+	const id = 1
+	sentAt := time.Now()
+	session.pingMu.Lock()
+	session.pingWaiters[id] = make(chan time.Duration, 1)
+	session.pingSentAt[id] = sentAt
+	session.lastPingAt = sentAt
+	session.pingMu.Unlock()
+
+	// The peer answers: processPing deletes both pingWaiters[id] and
+	// pingSentAt[id].
+	session.processPing(&PingFrame{Id: id})
+
+	if _, stillTracked := session.pingSentAt[id]; stillTracked {
+		t.Fatal("test setup: expected processPing to delete the completed ping's pingSentAt entry")
+	}
+	if got := session.lastPingSentAt(); !got.Equal(sentAt) {
+		t.Fatalf("lastPingSentAt() = %v after the ping completed, want %v", got, sentAt)
+	}
+}
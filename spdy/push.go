@@ -0,0 +1,95 @@
+package spdy
+
+import (
+	"errors"
+	"net/http"
+)
+
+/*
+** Server push
+**
+** draft-mbelshe-httpbis-spdy-00 section 2.3.2 lets either peer associate a
+** new stream with one already open: a server handling a request can open
+** additional streams for resources it knows the client will need (e.g. the
+** CSS a page references) before the client asks for them. Those streams
+** are unidirectional (only the pushing side ever sends DATA) and carry the
+** parent's stream ID in the SYN_STREAM's associated-stream-id field
+** instead of 0.
+**
+** On the server side, Stream.Push does the SYN_STREAM dance and hands the
+** handler a Stream to write the pushed response on. On the client side,
+** Session.processFrame recognizes the associated-stream-id and parks the
+** pushed stream instead of routing it to the handler; PushedStreams lets
+** the client consume (or RstStream) those as they arrive.
+*/
+
+// pushedStreamBacklog bounds how many pushed streams Session will buffer
+// before a client that isn't reading PushedStreams starts blocking the
+// receive loop.
+const pushedStreamBacklog = 8
+
+/*
+** Push opens a new stream associated with `stream`, sends a SYN_STREAM for
+** it carrying FLAG_UNIDIRECTIONAL and the pushed :scheme/:host/:path
+** headers, and returns the new stream so the handler can write the pushed
+** body to it. It is only valid on a server-side stream.
+*/
+func (stream *Stream) Push(path string, headers http.Header) (*Stream, error) {
+	session := stream.session
+	if !session.Server {
+		return nil, errors.New("Push is only valid on a server-side stream")
+	}
+
+	newId := session.nextIdOut()
+	priority := session.priorityFor(stream.Id)
+	pushed, err := session.newStream(newId, true, priority)
+	if err != nil {
+		return nil, err
+	}
+	pushed.AssociatedId = stream.Id
+
+	pushedHeaders := http.Header{}
+	for k, v := range headers {
+		pushedHeaders[k] = v
+	}
+	pushedHeaders.Set(":scheme", headers.Get(":scheme"))
+	pushedHeaders.Set(":host", headers.Get(":host"))
+	pushedHeaders.Set(":path", path)
+
+	err = pushed.writeFrame(&SynStreamFrame{
+		StreamId:             pushed.Id,
+		AssociatedToStreamId: stream.Id,
+		CFHeader:             ControlFrameHeader{Flags: FlagUnidirectional},
+		Headers:              pushedHeaders,
+		Priority:             priority,
+	})
+	if err != nil {
+		session.CloseStream(pushed.Id)
+		return nil, err
+	}
+	return pushed, nil
+}
+
+/*
+** PushedStreams returns a channel of streams the peer has pushed to us:
+** incoming SYN_STREAMs whose associated-stream-id is non-zero, registered
+** like any other incoming stream (there is no separate reserved state)
+** and delivered here rather than dispatched to the handler. Callers should
+** either consume and read them like any other stream, or decline them
+** with RstStream(Cancel).
+*/
+func (session *Session) PushedStreams() <-chan *Stream {
+	return session.pushed
+}
+
+// RstStream sends RST_STREAM with `status` for this stream and tears it
+// down locally; it's how a client declines a pushed stream it doesn't want.
+func (stream *Stream) RstStream(status StatusCode) error {
+	session := stream.session
+	err := session.WriteFrame(&RstStreamFrame{
+		StreamId: stream.Id,
+		Status:   status,
+	})
+	session.CloseStream(stream.Id)
+	return err
+}
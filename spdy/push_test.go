@@ -0,0 +1,23 @@
+package spdy
+
+import "testing"
+
+// TestSessionPushedStreamsDeliversParkedStreams verifies PushedStreams
+// surfaces a stream parked on the pushed channel (what processFrame does
+// for an incoming pushed SYN_STREAM), rather than the channel only being
+// reachable from Push's own server-side send.
+func TestSessionPushedStreamsDeliversParkedStreams(t *testing.T) {
+	session := &Session{pushed: make(chan *Stream, pushedStreamBacklog)}
+
+	pushed := &Stream{}
+	session.pushed <- pushed
+
+	select {
+	case got := <-session.PushedStreams():
+		if got != pushed {
+			t.Fatalf("PushedStreams() delivered %v, want %v", got, pushed)
+		}
+	default:
+		t.Fatal("PushedStreams() channel was empty")
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
 /*
@@ -33,29 +35,192 @@ type Session struct {
 	Server       bool   // Are we the server? (necessary for stream ID numbering)
 	lastStreamIdOut uint32 // Last (and highest-numbered) stream ID we allocated
 	lastStreamIdIn	uint32 // Last (and highest-numbered) stream ID we received
-	streams      map[uint32]*Stream
+
+	// streams is read and mutated from several goroutines (run(), Close,
+	// Shutdown's polling, the pushed-stream handling in processFrame), so
+	// every access goes through streamsMu rather than relying on there
+	// being a single owner.
+	streamsMu sync.Mutex
+	streams   map[uint32]*Stream
+
 	handler      http.Handler
 	conn         net.Conn
 	closed       bool
+
+	// Flow control (see flowcontrol.go / stream_window.go). connSendWindow
+	// and connRecvWindow mirror HTTP/2's connection window: they bound the
+	// total amount of unacknowledged DATA in flight across every stream, on
+	// top of each stream's own window in sendWindows/recvWindows.
+	initialWindowSize int32
+	windowMu          sync.Mutex
+	sendWindows       map[uint32]*flowWindow
+	recvWindows       map[uint32]*flowWindow
+	connSendWindow    *flowWindow
+	connRecvWindow    *flowWindow
+
+	// writeSched serializes outbound stream frames (see writesched.go):
+	// Stream.writeFrame calls Session.QueueFrame instead of writing to
+	// the connection directly, so concurrent streams interleave
+	// by priority instead of racing for the socket. writeSchedMu guards the
+	// field itself, since SetWriteScheduler can swap it in from any
+	// goroutine while writeLoop is reading it from its own.
+	writeSchedMu sync.Mutex
+	writeSched   WriteScheduler
+
+	// priorities holds the SPDY priority each stream was opened with (set
+	// from the SYN_STREAM's priority field), so QueueFrame knows which
+	// queue a stream's frames belong in.
+	priorityMu sync.Mutex
+	priorities map[uint32]uint8
+
+	// pushed surfaces server-pushed streams (see push.go): incoming
+	// SYN_STREAMs whose associated-stream-id is non-zero are parked here
+	// instead of being dispatched to the handler.
+	pushed chan *Stream
+
+	// Version is the negotiated SPDY draft version. headerCodec is seeded
+	// with the same zlib dictionary whatever its value (see headercodec.go).
+	Version     Version
+	headerCodec *headerCodec
+
+	// Keepalive / health (see keepalive.go). All three are zero (disabled)
+	// by default; set them before traffic starts to opt in.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	IdleTimeout  time.Duration
+
+	pingMu      sync.Mutex
+	lastPingId  uint32
+	pingSentAt  map[uint32]time.Time
+	pingWaiters map[uint32]chan time.Duration
+	lastRTT     time.Duration
+	// lastPingAt is when the most recent PING was sent, kept even after
+	// that PING completes; it's what paces PingInterval. Unlike
+	// pingSentAt, a completed ping's entry here is never deleted.
+	lastPingAt time.Time
+
+	lastFrameMu sync.Mutex
+	lastFrameAt time.Time
+
+	// Graceful shutdown (see shutdown.go). shuttingDown is set once we've
+	// sent our own GOAWAY; peerGoneAway/peerLastGoodStreamId record the
+	// peer's, once it sends one.
+	shutdownMu           sync.Mutex
+	shuttingDown         bool
+	peerGoneAway         bool
+	peerLastGoodStreamId uint32
 }
 
 
-func NewSession(framer FrameReadWriter, handler http.Handler, server bool) *Session {
+func NewSession(framer FrameReadWriter, handler http.Handler, server bool, version Version) *Session {
 	session := &Session{
 		FrameReadWriter:	framer,
 		Server:		server,
 		streams:	make(map[uint32]*Stream),
 		handler:	handler,
+		initialWindowSize: defaultInitialWindowSize,
+		sendWindows:       make(map[uint32]*flowWindow),
+		recvWindows:       make(map[uint32]*flowWindow),
+		connSendWindow:    newFlowWindow(defaultInitialWindowSize),
+		connRecvWindow:    newFlowWindow(defaultInitialWindowSize),
+		writeSched:        newPriorityWriteScheduler(),
+		priorities:        make(map[uint32]uint8),
+		pushed:            make(chan *Stream, pushedStreamBacklog),
+		Version:           version,
+		pingSentAt:        make(map[uint32]time.Time),
+		pingWaiters:       make(map[uint32]chan time.Duration),
+		lastFrameAt:       time.Now(),
 	}
+	session.headerCodec = newHeaderCodec(version)
 	go session.run()
+	go session.writeLoop()
+	go session.keepaliveLoop()
 	return session
 }
 
+/*
+** SetWriteScheduler swaps in a different WriteScheduler, e.g. a FIFO
+** scheduler in tests that need a deterministic send order. Unlike an
+** earlier version of this method, it's safe to call after streams have
+** started writing: the old scheduler is closed (waking writeLoop, which
+** picks up the new one) rather than silently abandoned.
+*/
+func (session *Session) SetWriteScheduler(sched WriteScheduler) {
+	session.writeSchedMu.Lock()
+	old := session.writeSched
+	session.writeSched = sched
+	session.writeSchedMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+func (session *Session) currentWriteScheduler() WriteScheduler {
+	session.writeSchedMu.Lock()
+	defer session.writeSchedMu.Unlock()
+	return session.writeSched
+}
+
+/*
+** QueueFrame hands a stream-originated frame to the write scheduler
+** instead of writing it to the connection immediately, so frames from
+** concurrent streams are interleaved by priority rather than by
+** goroutine scheduling order.
+*/
+func (session *Session) QueueFrame(frame Frame, priority uint8) {
+	session.currentWriteScheduler().Queue(frame, priority)
+}
+
+/*
+** writeLoop drains the write scheduler and writes every frame queued
+** through QueueFrame to the underlying connection. Frames outside the
+** scheduler still go out through WriteFrame from their own goroutines:
+** what newStream's goroutine copies from stream.Output, and the control
+** frames Session writes itself (PING, RST_STREAM, GOAWAY, WINDOW_UPDATE).
+** A scheduler's Pop
+** returning nil normally means writeLoop should exit (the scheduler was
+** closed for teardown), but SetWriteScheduler also closes the outgoing
+** scheduler to unblock Pop when swapping it out; writeLoop distinguishes
+** the two by checking whether session.writeSched still points at the
+** scheduler whose Pop just returned, and picks up the new one instead of
+** exiting if it doesn't.
+*/
+func (session *Session) writeLoop() {
+	sched := session.currentWriteScheduler()
+	for {
+		frame := sched.Pop()
+		if frame == nil {
+			if next := session.currentWriteScheduler(); next != sched {
+				sched = next
+				continue
+			}
+			return
+		}
+		if err := session.WriteFrame(frame); err != nil {
+			session.Close()
+			return
+		}
+	}
+}
+
 func (session *Session) Close() {
 	session.closed = true
-	for id := range session.streams {
+	// Wake any writer blocked on the connection-wide window before the
+	// per-stream windows: dropWindows below closes those, but a writer
+	// waiting in reserveSendWindow is parked on connSendWindow first.
+	session.connSendWindow.Close()
+	session.connRecvWindow.Close()
+	for _, id := range session.streamIds() {
 		session.CloseStream(id)
 	}
+	// Unblock writeLoop, parked in Pop() waiting for a frame to send.
+	session.currentWriteScheduler().Close()
+	// Unblock run()'s ReadFrame() by closing the underlying transport, if
+	// it's closeable; without this the read goroutine (and the connection
+	// it holds open) leaks on every teardown.
+	if closer, ok := session.FrameReadWriter.(io.Closer); ok {
+		closer.Close()
+	}
 }
 
 func (session *Session) Closed() bool {
@@ -103,12 +268,18 @@ func (session *Session) nextIdIn() uint32 {
 
 /*
 ** OpenStream() initiates a new local stream. It does not send SYN_STREAM or
-** any other frame. That is the responsibility of the caller. 
+** any other frame. That is the responsibility of the caller, who should
+** send the SYN_STREAM with the same `priority` it passes here, since that
+** is the value the write scheduler (see writesched.go) will use for every
+** later frame on this stream.
 */
 
-func (session *Session) OpenStream() (*Stream, error) {
+func (session *Session) OpenStream(priority uint8) (*Stream, error) {
+	if err := session.shutdownError(); err != nil {
+		return nil, err
+	}
 	newId := session.nextIdOut()
-	if stream, err := session.newStream(newId, true); err != nil {
+	if stream, err := session.newStream(newId, true, priority); err != nil {
 		return nil, err
 	} else {
 		return stream, nil
@@ -123,7 +294,7 @@ func (session *Session) OpenStream() (*Stream, error) {
  * If `id` is invalid or already registered, the call will fail.
  */
 
-func (session *Session) newStream(id uint32, local bool) (*Stream, error) {
+func (session *Session) newStream(id uint32, local bool, priority uint8) (*Stream, error) {
 	/* Is this ID valid? */
 	if local {
 		if !session.isLocalId(id) || id != session.nextIdOut() {
@@ -135,12 +306,16 @@ func (session *Session) newStream(id uint32, local bool) (*Stream, error) {
 		}
 	}
 	debug("ID=%d (isLocalID: %v) local=%v: ok", id, session.isLocalId(id), local)
+	session.streamsMu.Lock()
 	/* Is this ID already in use? */
 	if _, alreadyExists := session.streams[id]; alreadyExists {
+		session.streamsMu.Unlock()
 		return nil, errors.New(fmt.Sprintf("Stream %d already exists", id))
 	}
 	stream := NewStream(id, local)
 	session.streams[id] = stream
+	session.streamsMu.Unlock()
+	session.setPriority(id, priority)
 	if local {
 		session.lastStreamIdOut = id
 	} else {
@@ -162,15 +337,41 @@ func (session *Session) newStream(id uint32, local bool) (*Stream, error) {
 }
 
 func (session *Session) CloseStream(id uint32) error {
+	session.streamsMu.Lock()
 	stream, exists := session.streams[id]
 	if !exists {
+		session.streamsMu.Unlock()
 		return errors.New(fmt.Sprintf("No such stream: %v", id))
 	}
-	stream.Input.Close()
 	delete(session.streams, id)
+	session.streamsMu.Unlock()
+	stream.Input.Close()
+	session.dropWindows(id)
+	session.dropPriority(id)
 	return nil
 }
 
+// streamIds returns a snapshot of currently open stream ids, for callers
+// that need to range over every stream (Close, handlePeerGoAway) without
+// holding streamsMu while they do something that might itself touch
+// session.streams, such as calling CloseStream.
+func (session *Session) streamIds() []uint32 {
+	session.streamsMu.Lock()
+	defer session.streamsMu.Unlock()
+	ids := make([]uint32, 0, len(session.streams))
+	for id := range session.streams {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (session *Session) getStream(id uint32) (*Stream, bool) {
+	session.streamsMu.Lock()
+	defer session.streamsMu.Unlock()
+	stream, exists := session.streams[id]
+	return stream, exists
+}
+
 /*
 ** Listen for new frames and process them
  */
@@ -185,10 +386,18 @@ func (session *Session) run() error {
 	for {
 		rawframe, err := session.ReadFrame()
 		if err != nil {
+			if _, fatal := err.(*headerDecodeError); fatal {
+				/* A header decompression failure desyncs headerCodec's zlib
+				   window for the rest of the connection, so per spec this is
+				   fatal: tell the peer why, then tear the session down. */
+				debug("Fatal header decompression error: %s", err)
+				session.WriteFrame(&RstStreamFrame{Status: ProtocolError})
+			}
 			session.Close()
 			return err
 		}
 		debug("Received frame %s\n", rawframe)
+		session.touchLastFrame()
 		session.processFrame(rawframe)
 	}
 	return nil
@@ -200,6 +409,8 @@ func (session *Session) run() error {
 */
 
 func (session *Session) NStreams() int {
+	session.streamsMu.Lock()
+	defer session.streamsMu.Unlock()
 	return len(session.streams)
 }
 
@@ -210,9 +421,20 @@ func (session *Session) processFrame(frame Frame) {
 	if streamId := frame.GetStreamId(); streamId != 0 {
 		debug("streamId = %s", streamId)
 		/* SYN_STREAM frame: create the stream */
-		if _, ok := frame.(*SynStreamFrame); ok {
+		if syn, ok := frame.(*SynStreamFrame); ok {
+			if session.isShuttingDown() {
+				/* We already told the peer our last good stream id via
+				   GOAWAY; anything it opens after that is refused rather
+				   than silently accepted, so the peer can retry elsewhere. */
+				debug("SYN_STREAM: refusing stream %d, session is shutting down", streamId)
+				session.WriteFrame(&RstStreamFrame{
+					StreamId: streamId,
+					Status:   RefusedStream,
+				})
+				return
+			}
 			debug("SYN_STREAM: creating new stream")
-			if stream, err := session.newStream(streamId, false); err != nil {
+			if stream, err := session.newStream(streamId, false, syn.Priority); err != nil {
 				/* protocol error */
 				debug("Protocol error on SYN_STREAM: %s", err)
 				session.WriteFrame(&RstStreamFrame{
@@ -220,11 +442,20 @@ func (session *Session) processFrame(frame Frame) {
 					Status: ProtocolError,
 				})
 				return
+			} else if syn.AssociatedToStreamId != 0 {
+				/* Server push: this SYN_STREAM was opened by the peer on our
+				   behalf rather than in answer to one of our requests, so it
+				   doesn't go through the handler. It is registered like any
+				   other incoming stream (there is no separate reserved state)
+				   and handed to the caller on the pushed channel (see push.go). */
+				debug("SYN_STREAM: stream %d pushed, associated with %d", streamId, syn.AssociatedToStreamId)
+				stream.AssociatedId = syn.AssociatedToStreamId
+				session.pushed <- stream
 			} else {
 				go stream.Serve(session.handler)
 			}
 		}
-		stream, exists := session.streams[streamId]
+		stream, exists := session.getStream(streamId)
 		if !exists {
 			/* protocol error */
 			debug("Protocol error: stream id %d does not exist", streamId)
@@ -234,6 +465,21 @@ func (session *Session) processFrame(frame Frame) {
 			})
 			return
 		}
+		/* WINDOW_UPDATE replenishes the stream's send window; it never reaches
+		   the stream's Input queue since it isn't part of the stream's data. */
+		if wuf, ok := frame.(*WindowUpdateFrame); ok {
+			debug("WINDOW_UPDATE: stream %d += %d", streamId, wuf.DeltaWindowSize)
+			session.sendWindowFor(streamId).Increase(int32(wuf.DeltaWindowSize))
+			return
+		}
+		/* DATA spends recv-window credit (section 2.6.9): account for it
+		   before handing the frame off, mirroring what reserveSendWindow
+		   does on the send side. */
+		if df, ok := frame.(*DataFrame); ok {
+			n := int32(len(df.Data))
+			session.recvWindowFor(streamId).Increase(-n)
+			session.connRecvWindow.Increase(-n)
+		}
 		debug("Sending frame %v to stream %d", frame, streamId)
 		err := stream.Input.WriteFrame(frame)
 		debug("done")
@@ -248,14 +494,30 @@ func (session *Session) processFrame(frame Frame) {
 		/* Close the stream if there's an error */
 			session.CloseStream(streamId)
 			return
+		} else if df, ok := frame.(*DataFrame); ok {
+			/* The frame was accepted, so replenish the credit it just spent
+			   right back to the peer. This package doesn't yet give Session
+			   a way to pace that on how fast a handler actually drains
+			   stream.Input, so credit is granted back as soon as data is
+			   accepted rather than as it's read; see WindowUpdate. */
+			if werr := stream.WindowUpdate(uint32(len(df.Data))); werr != nil {
+				debug("WINDOW_UPDATE send failed for stream %d: %s", streamId, werr)
+			}
 		}
 	/* Is this frame session-wide? */
 	} else {
-		switch frame.(type) {
-			case *SettingsFrame:	debug("SETTINGS\n")
+		switch f := frame.(type) {
+			case *SettingsFrame:
+				debug("SETTINGS\n")
+				if window, ok := f.Settings[SettingsInitialWindowSize]; ok {
+					session.applyInitialWindowSize(int32(window))
+				}
+			case *WindowUpdateFrame:
+				debug("WINDOW_UPDATE (connection): += %d\n", f.DeltaWindowSize)
+				session.connSendWindow.Increase(int32(f.DeltaWindowSize))
 			case *NoopFrame:		debug("NOOP\n")
-			case *PingFrame:		debug("PING\n")
-			case *GoAwayFrame:		debug("GOAWAY\n")
+			case *PingFrame:		session.processPing(f)
+			case *GoAwayFrame:		session.handlePeerGoAway(f.LastGoodStreamId)
 			default:			debug("Unknown frame type!")
 		}
 	}
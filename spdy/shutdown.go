@@ -0,0 +1,97 @@
+package spdy
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+/*
+** Graceful shutdown
+**
+** Session.Close force-closes every stream immediately, which drops
+** whatever was in flight. Shutdown is the polite alternative, mirroring
+** what a GOAWAY-aware HTTP/2 server does: announce the last stream we'll
+** still service, stop accepting new ones, and only close the connection
+** once the streams that were already open have finished (or ctx gives up
+** on waiting). Receiving a GOAWAY from the peer is handled the same way
+** in reverse: streams we opened that the peer never saw are cancelled
+** locally instead of being left to hang forever.
+*/
+
+/*
+** Shutdown sends a GOAWAY advertising the last stream we've accepted,
+** refuses any new inbound SYN_STREAMs from then on (and fails local
+** OpenStream calls), then waits for every already-open stream to finish
+** before closing the underlying connection. If ctx is done first, the
+** connection is closed immediately and ctx.Err() is returned.
+*/
+func (session *Session) Shutdown(ctx context.Context) error {
+	session.shutdownMu.Lock()
+	if session.shuttingDown {
+		session.shutdownMu.Unlock()
+		return errors.New("spdy: Shutdown already in progress")
+	}
+	session.shuttingDown = true
+	session.shutdownMu.Unlock()
+
+	session.WriteFrame(&GoAwayFrame{
+		LastGoodStreamId: session.lastStreamIdIn,
+		Status:           Ok,
+	})
+
+	ticker := time.NewTicker(keepaliveGranularity)
+	defer ticker.Stop()
+	for session.NStreams() > 0 {
+		select {
+		case <-ticker.C:
+			continue
+		case <-ctx.Done():
+			session.Close()
+			return ctx.Err()
+		}
+	}
+	session.Close()
+	return nil
+}
+
+func (session *Session) isShuttingDown() bool {
+	session.shutdownMu.Lock()
+	defer session.shutdownMu.Unlock()
+	return session.shuttingDown
+}
+
+// shutdownError returns a non-nil error once this session (via Shutdown)
+// or the peer (via GOAWAY) has announced it won't accept new streams,
+// which is what OpenStream checks before allocating a new stream id.
+func (session *Session) shutdownError() error {
+	session.shutdownMu.Lock()
+	defer session.shutdownMu.Unlock()
+	if session.shuttingDown {
+		return errors.New("spdy: session is shutting down")
+	}
+	if session.peerGoneAway {
+		return errors.New("spdy: peer sent GOAWAY, no new streams")
+	}
+	return nil
+}
+
+/*
+** handlePeerGoAway processes a received GOAWAY: it records the peer's
+** last-good stream id and cancels any stream we opened locally with a
+** higher id, since the peer is telling us it never processed those.
+*/
+func (session *Session) handlePeerGoAway(lastGoodStreamId uint32) {
+	debug("GOAWAY: peer's last good stream id is %d\n", lastGoodStreamId)
+	session.shutdownMu.Lock()
+	session.peerGoneAway = true
+	session.peerLastGoodStreamId = lastGoodStreamId
+	session.shutdownMu.Unlock()
+
+	for _, id := range session.streamIds() {
+		if session.isLocalId(id) && id > lastGoodStreamId {
+			debug("GOAWAY: cancelling local stream %d, peer never saw it\n", id)
+			session.CloseStream(id)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package spdy
+
+import "testing"
+
+// TestSessionShutdownErrorReflectsState verifies shutdownError only
+// starts rejecting new streams once Shutdown has actually set
+// shuttingDown, and that isShuttingDown agrees.
+func TestSessionShutdownErrorReflectsState(t *testing.T) {
+	session := &Session{}
+
+	if err := session.shutdownError(); err != nil {
+		t.Fatalf("shutdownError() on a fresh session = %v, want nil", err)
+	}
+	if session.isShuttingDown() {
+		t.Fatal("isShuttingDown() = true on a fresh session")
+	}
+
+	session.shutdownMu.Lock()
+	session.shuttingDown = true
+	session.shutdownMu.Unlock()
+
+	if err := session.shutdownError(); err == nil {
+		t.Fatal("shutdownError() after Shutdown started = nil, want an error")
+	}
+	if !session.isShuttingDown() {
+		t.Fatal("isShuttingDown() = false after shuttingDown was set")
+	}
+}
+
+// TestSessionShutdownErrorAfterPeerGoAway verifies a GOAWAY received from
+// the peer also makes shutdownError reject new streams, independent of
+// whether we've sent our own.
+func TestSessionShutdownErrorAfterPeerGoAway(t *testing.T) {
+	session := &Session{}
+
+	session.shutdownMu.Lock()
+	session.peerGoneAway = true
+	session.shutdownMu.Unlock()
+
+	if err := session.shutdownError(); err == nil {
+		t.Fatal("shutdownError() after a peer GOAWAY = nil, want an error")
+	}
+}
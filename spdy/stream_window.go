@@ -0,0 +1,170 @@
+package spdy
+
+import "errors"
+
+/*
+** Per-stream flow-control windows, keyed off the owning Session so that
+** Stream itself doesn't need to carry any locking of its own: the window
+** a stream writes against (how many bytes of DATA it may still send) and
+** the window it reads against (how many bytes it has told the peer it
+** will accept) both live on Session, indexed by stream ID.
+*/
+
+func (session *Session) sendWindowFor(streamId uint32) *flowWindow {
+	session.windowMu.Lock()
+	defer session.windowMu.Unlock()
+	w, ok := session.sendWindows[streamId]
+	if !ok {
+		w = newFlowWindow(session.initialWindowSize)
+		session.sendWindows[streamId] = w
+	}
+	return w
+}
+
+func (session *Session) recvWindowFor(streamId uint32) *flowWindow {
+	session.windowMu.Lock()
+	defer session.windowMu.Unlock()
+	w, ok := session.recvWindows[streamId]
+	if !ok {
+		w = newFlowWindow(session.initialWindowSize)
+		session.recvWindows[streamId] = w
+	}
+	return w
+}
+
+/*
+** dropWindows discards streamId's windows and closes them first, so a
+** writer already blocked in Reserve on this stream's send window (waiting
+** on credit a now-gone peer will never send) wakes up instead of hanging
+** forever.
+*/
+func (session *Session) dropWindows(streamId uint32) {
+	session.windowMu.Lock()
+	sendWindow, hadSendWindow := session.sendWindows[streamId]
+	recvWindow, hadRecvWindow := session.recvWindows[streamId]
+	delete(session.sendWindows, streamId)
+	delete(session.recvWindows, streamId)
+	session.windowMu.Unlock()
+	if hadSendWindow {
+		sendWindow.Close()
+	}
+	if hadRecvWindow {
+		recvWindow.Close()
+	}
+}
+
+/*
+** SetSendWindow adjusts the credit the stream has to send DATA, relative
+** to the default initial window size. Handlers may call it directly to
+** give one stream more (or less) headroom: the window is credited with
+** n - defaultInitialWindowSize, whatever initial window size a SETTINGS
+** frame has set for the session since.
+*/
+func (stream *Stream) SetSendWindow(n int32) {
+	stream.session.sendWindowFor(stream.Id).Increase(n - defaultInitialWindowSize)
+}
+
+/*
+** applyInitialWindowSize updates the window size new streams are created
+** with, and adjusts every currently open stream's send window by the same
+** delta. Per section 2.6.9, SETTINGS_INITIAL_WINDOW_SIZE changes the
+** window for streams already open on the connection too, not just ones
+** opened afterward; without this, a SETTINGS frame arriving mid-connection
+** only ever affected streams lazily created later.
+*/
+func (session *Session) applyInitialWindowSize(window int32) {
+	session.windowMu.Lock()
+	delta := window - session.initialWindowSize
+	session.initialWindowSize = window
+	windows := make([]*flowWindow, 0, len(session.sendWindows))
+	for _, w := range session.sendWindows {
+		windows = append(windows, w)
+	}
+	session.windowMu.Unlock()
+	for _, w := range windows {
+		w.Increase(delta)
+	}
+}
+
+/*
+** WindowUpdate tells the peer it may send `delta` more bytes of DATA on
+** this stream. processFrame calls this as soon as an incoming DATA frame
+** is accepted onto the stream's input queue, replenishing the credit it
+** just spent; handlers that want tighter backpressure based on how fast
+** they actually drain that queue can still call it themselves.
+*/
+func (stream *Stream) WindowUpdate(delta uint32) error {
+	if delta == 0 {
+		return nil
+	}
+	stream.session.recvWindowFor(stream.Id).Increase(int32(delta))
+	return stream.session.WriteFrame(&WindowUpdateFrame{
+		StreamId:        stream.Id,
+		DeltaWindowSize: delta,
+	})
+}
+
+/*
+** reserveSendWindow blocks a writer until it may send up to `want` bytes
+** of DATA on `streamId`, honoring both that stream's window and the
+** connection-wide window (mirroring HTTP/2's connection window) so a
+** single stalled stream can't starve the others. It returns the number of
+** bytes actually granted, which may be less than `want`, or -1 if the
+** stream or session tore down while this call was waiting on credit.
+*/
+func (session *Session) reserveSendWindow(streamId uint32, want int32) int32 {
+	granted := session.connSendWindow.Reserve(want)
+	if granted < 0 {
+		return granted
+	}
+	streamGranted := session.sendWindowFor(streamId).Reserve(granted)
+	if streamGranted < 0 {
+		// Hand back what we reserved from the connection window; nobody
+		// else is going to use this stream's share of it.
+		session.connSendWindow.Increase(granted)
+		return streamGranted
+	}
+	if streamGranted < granted {
+		// Hand back what we didn't use so another stream can use it.
+		session.connSendWindow.Increase(granted - streamGranted)
+	}
+	return streamGranted
+}
+
+/*
+** WriteDataFrame sends `data` on `streamId`, blocking and chunking it
+** across as many DATA frames as the current send windows require. This is
+** the flow-control-aware counterpart to WriteFrame that Stream.Send uses
+** instead of writing DataFrames directly. Frames are handed to the write
+** scheduler (see writesched.go) rather than written straight to the
+** connection, so a large chunked upload interleaves with other streams'
+** frames instead of monopolizing the connection.
+*/
+func (session *Session) WriteDataFrame(streamId uint32, data []byte) error {
+	priority := session.priorityFor(streamId)
+	for len(data) > 0 {
+		n := session.reserveSendWindow(streamId, int32(len(data)))
+		if n < 0 {
+			return errors.New("spdy: send window closed")
+		}
+		if n == 0 {
+			continue
+		}
+		session.QueueFrame(&DataFrame{
+			StreamId: streamId,
+			Data:     data[:n],
+		}, priority)
+		data = data[n:]
+	}
+	return nil
+}
+
+/*
+** Send writes `data` on the stream as DATA, going through WriteDataFrame
+** so it blocks and chunks against the stream's and the connection's send
+** windows instead of writing a DataFrame straight to the connection and
+** ignoring flow control entirely.
+*/
+func (stream *Stream) Send(data []byte) error {
+	return stream.session.WriteDataFrame(stream.Id, data)
+}
@@ -0,0 +1,139 @@
+package spdy
+
+import "sync"
+
+/*
+** Write scheduling
+**
+** Frames that streams write through session.WriteFrame from their own
+** goroutines race for the connection in whatever order the Go scheduler
+** happens to run them, and SPDY's 3-bit priority field (section 2.3.3)
+** plays no part in that. A WriteScheduler centralizes the decision for
+** frames queued through it (Stream.writeFrame, WriteDataFrame): each is
+** tagged with the priority its stream was opened with, and a single
+** goroutine drains the highest-priority non-empty queue, so a large
+** low-priority upload can't starve a small high-priority request. The
+** goroutine newStream starts to copy stream.Output still writes to the
+** session directly, outside the scheduler.
+**
+** The interface is pluggable (mirroring x/net/http2's writeScheduler) so
+** callers can swap in a simpler FIFO scheduler for tests that care about
+** ordering rather than priority.
+*/
+
+// SPDY/3 priorities run 0 (highest) through 7 (lowest); SPDY/2 only uses
+// the top two bits of that range.
+const numPriorities = 8
+
+type WriteScheduler interface {
+	// Queue enqueues frame to be written at the given priority.
+	Queue(frame Frame, priority uint8)
+	// Pop blocks until a frame is available and returns it, or returns nil
+	// once the scheduler has been closed and drained.
+	Pop() Frame
+	// Close unblocks any pending Pop and stops accepting new frames.
+	Close()
+}
+
+/* priorityWriteScheduler is the default WriteScheduler: one FIFO queue per
+   priority class, highest priority first. */
+type priorityWriteScheduler struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues [numPriorities][]Frame
+	closed bool
+}
+
+func newPriorityWriteScheduler() *priorityWriteScheduler {
+	s := &priorityWriteScheduler{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *priorityWriteScheduler) Queue(frame Frame, priority uint8) {
+	if priority >= numPriorities {
+		priority = numPriorities - 1
+	}
+	s.mu.Lock()
+	if !s.closed {
+		s.queues[priority] = append(s.queues[priority], frame)
+	}
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *priorityWriteScheduler) Pop() Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for p := 0; p < numPriorities; p++ {
+			if len(s.queues[p]) > 0 {
+				frame := s.queues[p][0]
+				s.queues[p] = s.queues[p][1:]
+				return frame
+			}
+		}
+		if s.closed {
+			return nil
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *priorityWriteScheduler) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+/* fifoWriteScheduler ignores priority entirely; it's a single queue for
+   tests that want deterministic send order regardless of priority. */
+type fifoWriteScheduler struct {
+	priorityWriteScheduler
+}
+
+func newFIFOWriteScheduler() *fifoWriteScheduler {
+	s := &fifoWriteScheduler{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *fifoWriteScheduler) Queue(frame Frame, priority uint8) {
+	s.priorityWriteScheduler.Queue(frame, 0)
+}
+
+/*
+** priorityFor/setPriority/dropPriority track the SPDY priority each
+** stream was opened with (taken from its SYN_STREAM), so QueueFrame can
+** look it up without threading it through every call site that writes a
+** stream frame.
+*/
+func (session *Session) priorityFor(streamId uint32) uint8 {
+	session.priorityMu.Lock()
+	defer session.priorityMu.Unlock()
+	return session.priorities[streamId]
+}
+
+func (session *Session) setPriority(streamId uint32, priority uint8) {
+	session.priorityMu.Lock()
+	session.priorities[streamId] = priority
+	session.priorityMu.Unlock()
+}
+
+func (session *Session) dropPriority(streamId uint32) {
+	session.priorityMu.Lock()
+	delete(session.priorities, streamId)
+	session.priorityMu.Unlock()
+}
+
+/*
+** writeFrame is the scheduled counterpart to Session.WriteFrame: stream
+** code should call this instead of writing to the connection directly so
+** concurrent streams interleave by priority instead of by goroutine
+** scheduling order.
+*/
+func (stream *Stream) writeFrame(frame Frame) error {
+	stream.session.QueueFrame(frame, stream.session.priorityFor(stream.Id))
+	return nil
+}
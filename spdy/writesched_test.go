@@ -0,0 +1,56 @@
+package spdy
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWriteSchedulerCloseWakesPop verifies that Close unblocks a Pop
+// already waiting for a frame, returning nil rather than hanging forever.
+func TestWriteSchedulerCloseWakesPop(t *testing.T) {
+	s := newPriorityWriteScheduler()
+
+	result := make(chan Frame, 1)
+	go func() { result <- s.Pop() }()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+
+	select {
+	case frame := <-result:
+		if frame != nil {
+			t.Fatalf("Pop on a closed scheduler = %v, want nil", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop did not wake up after the scheduler was closed")
+	}
+}
+
+// TestSessionSetWriteSchedulerClosesOldScheduler verifies that swapping in
+// a new WriteScheduler closes the old one, so a writeLoop parked in the
+// old scheduler's Pop() wakes up instead of staying blocked on a scheduler
+// nothing queues to anymore.
+func TestSessionSetWriteSchedulerClosesOldScheduler(t *testing.T) {
+	old := newFIFOWriteScheduler()
+	session := &Session{writeSched: old}
+
+	popped := make(chan Frame, 1)
+	go func() { popped <- old.Pop() }()
+	time.Sleep(10 * time.Millisecond)
+
+	next := newFIFOWriteScheduler()
+	session.SetWriteScheduler(next)
+
+	select {
+	case frame := <-popped:
+		if frame != nil {
+			t.Fatalf("old scheduler's Pop = %v, want nil after being swapped out", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("old scheduler's Pop did not wake up after SetWriteScheduler swapped it out")
+	}
+
+	if got := session.currentWriteScheduler(); got != WriteScheduler(next) {
+		t.Fatalf("currentWriteScheduler() = %v, want the scheduler passed to SetWriteScheduler", got)
+	}
+}